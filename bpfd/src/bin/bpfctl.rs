@@ -126,9 +126,12 @@ async fn main() -> Result<(), Box<dyn std::error::Error>> {
             let response = client.list(request).await?.into_inner();
             for r in response.results {
                 println!(
-                    "{}: {}\n\tname: \"{}\"\n\tpriority: {}\n\tpath: {}",
-                    r.position, r.id, r.name, r.priority, r.path
-                )
+                    "{}: {}\n\tname: \"{}\"\n\tpriority: {}\n\tpath: {}\n\txdp mode: {}",
+                    r.position, r.id, r.name, r.priority, r.path, r.xdp_mode
+                );
+                if !r.xdp_fallback_reason.is_empty() {
+                    println!("\txdp fallback reason: {}", r.xdp_fallback_reason)
+                }
             }
         }
     };
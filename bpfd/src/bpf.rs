@@ -1,28 +1,37 @@
 use aya::{
     maps::MapFd,
     programs::{
-        extension::ExtensionLink, xdp::XdpLink, Extension, OwnedLink, ProgramFd, Xdp, XdpFlags,
+        extension::ExtensionLink,
+        xdp::{XdpLink, XdpLinkId},
+        Extension, OwnedLink, ProgramError, ProgramFd, Xdp, XdpFlags,
     },
     Bpf, BpfLoader,
 };
-use log::info;
+use log::{info, warn};
 use nix::{
+    errno::Errno,
     fcntl::{fcntl, FcntlArg},
     sys::socket::{
         sendmsg, socket, AddressFamily, ControlMessage, MsgFlags, SockFlag, SockType, UnixAddr,
     },
     unistd::close,
 };
-use std::{collections::HashMap, io::IoSlice, path::Path};
+use std::{collections::HashMap, io::IoSlice, os::unix::io::RawFd, path::Path};
 use uuid::Uuid;
 
 use bpfd_common::*;
 
-use crate::errors::BpfdError;
+use crate::errors::{io_error, BpfdError};
 
 const DEFAULT_ACTIONS_MAP: u32 = 1 << 2;
 const DEFAULT_PRIORITY: u32 = 50;
 const DISPATCHER_PROGRAM_NAME: &str = "dispatcher";
+// Modes to try, in order, when attaching a dispatcher to an interface.
+// Offload isn't an option as freplace programs can't be offloaded.
+// We only move on to the next mode when the driver rejects the current one
+// with EOPNOTSUPP (no native XDP) or EINVAL (e.g. MTU too large or no
+// multi-buffer support). Drivers that fail any other way fail the attach.
+const XDP_MODES: [XdpFlags; 2] = [XdpFlags::DRV_MODE, XdpFlags::SKB_MODE];
 
 #[derive(Debug, Eq, Ord, PartialEq, PartialOrd)]
 pub(crate) struct Metadata {
@@ -42,6 +51,8 @@ pub(crate) struct ExtensionProgram {
 pub(crate) struct DispatcherProgram {
     loader: Bpf,
     link: Option<OwnedLink<XdpLink>>,
+    mode: XdpFlags,
+    fallback_reason: Option<String>,
 }
 
 #[derive(Debug, Clone)]
@@ -51,6 +62,8 @@ pub(crate) struct ProgramInfo {
     pub(crate) path: String,
     pub(crate) position: usize,
     pub(crate) priority: i32,
+    pub(crate) xdp_mode: String,
+    pub(crate) xdp_fallback_reason: String,
 }
 
 pub(crate) struct BpfManager {
@@ -76,19 +89,13 @@ impl BpfManager {
         section_name: String,
     ) -> Result<Uuid, BpfdError> {
         let id = Uuid::new_v4();
-        let next_available_id = if let Some(prog) = self.programs.get(&iface) {
-            prog.len()
-        } else {
-            self.programs.insert(iface.clone(), HashMap::new());
-            0
-        };
+        let next_available_id = self.programs.get(&iface).map_or(0, |p| p.len());
 
         if next_available_id > 9 {
             return Err(BpfdError::TooManyPrograms);
         }
 
-        let mut dispatcher_loader = new_dispatcher(next_available_id as u8, self.dispatcher_bytes)?;
-        self.programs.get_mut(&iface).unwrap().insert(
+        self.programs.entry(iface.clone()).or_default().insert(
             id,
             ExtensionProgram {
                 path,
@@ -103,10 +110,10 @@ impl BpfManager {
             },
         );
 
-        // Keep old_links in scope until after this function exits to avoid dropping
-        // them before the new dispatcher is attached
-        let _old_links = self.attach_extensions(&iface, &mut dispatcher_loader)?;
-        self.update_or_replace_dispatcher(iface.clone(), dispatcher_loader)?;
+        if let Err(e) = self.rebuild_dispatcher(&iface) {
+            self.forget_program(&iface, id)?;
+            return Err(e);
+        }
         info!(
             "{} programs attached to {}",
             self.programs.get(&iface).unwrap().len(),
@@ -121,53 +128,26 @@ impl BpfManager {
             if let Some(mut old_program) = programs.remove(&id) {
                 if programs.is_empty() {
                     if let Some(mut dispatcher) = self.dispatchers.remove(&iface) {
-                        // HACK: Close old dispatcher.
-                        // I'm not sure why this doesn't get cleaned up on drop of `Bpf`...
-                        // Probably some fancy refcount thing that isn't aware of bpf_link_update.
-                        // We should offer program.unload() to avoid unsafe + also fix this in Aya.
-                        let dispatcher_prog: &mut Xdp = dispatcher
-                            .loader
-                            .program_mut(DISPATCHER_PROGRAM_NAME)
-                            .unwrap()
-                            .try_into()?;
-                        if let Some(fd) = dispatcher_prog.fd() {
-                            close(fd).unwrap();
-                        }
-                    }
-                    // HACK: Close old exetnsion.
-                    let old_ext: &mut Extension = old_program
-                        .loader
-                        .as_mut()
-                        .unwrap()
-                        .program_mut(old_program.metadata.name.as_str())
-                        .unwrap()
-                        .try_into()?;
-                    if let Some(fd) = old_ext.fd() {
-                        close(fd).unwrap();
+                        close_dispatcher(&mut dispatcher.loader)?;
                     }
+                    close_extension(&mut old_program)?;
                     return Ok(());
                 }
 
-                let mut dispatcher_loader =
-                    new_dispatcher(programs.len() as u8, self.dispatcher_bytes)?;
-
-                // Keep old_links in scope until after this function exits to avoid dropping
-                // them before the new dispatcher is attached
-                let _old_links = self.attach_extensions(&iface, &mut dispatcher_loader)?;
-
-                self.update_or_replace_dispatcher(iface, dispatcher_loader)?;
-
-                // HACK: Close old exetnsion.
-                let old_ext: &mut Extension = old_program
-                    .loader
-                    .as_mut()
-                    .unwrap()
-                    .program_mut(old_program.metadata.name.as_str())
-                    .unwrap()
-                    .try_into()?;
-                if let Some(fd) = old_ext.fd() {
-                    close(fd).unwrap();
+                if let Err(e) = self.rebuild_dispatcher(&iface) {
+                    match self.programs.get_mut(&iface) {
+                        // Nothing live was changed, so the program is still linked
+                        // to the dispatcher on the interface. Put it back.
+                        Some(programs) => {
+                            programs.insert(id, old_program);
+                        }
+                        // The interface lost its dispatcher and everything on it
+                        None => close_extension(&mut old_program)?,
+                    }
+                    return Err(e);
                 }
+
+                close_extension(&mut old_program)?;
             } else {
                 return Err(BpfdError::InvalidID);
             }
@@ -183,6 +163,9 @@ impl BpfManager {
         }
         let mut results = vec![];
         if let Some(programs) = self.programs.get(&iface) {
+            let dispatcher = self.dispatchers.get(&iface);
+            let xdp_mode = dispatcher.map_or("", |d| xdp_mode_name(d.mode));
+            let xdp_fallback_reason = dispatcher.and_then(|d| d.fallback_reason.as_deref());
             let mut extensions = programs.iter().collect::<Vec<_>>();
             extensions.sort_by(|(_, a), (_, b)| a.current_position.cmp(&b.current_position));
             for (id, v) in extensions.iter() {
@@ -192,6 +175,8 @@ impl BpfManager {
                     path: v.path.clone(),
                     position: v.current_position.unwrap(),
                     priority: v.metadata.priority,
+                    xdp_mode: xdp_mode.to_string(),
+                    xdp_fallback_reason: xdp_fallback_reason.unwrap_or_default().to_string(),
                 })
             }
         } else {
@@ -236,6 +221,8 @@ impl BpfManager {
                 } else {
                     return Err(BpfdError::MapNotLoaded);
                 }
+            } else {
+                return Err(BpfdError::InvalidID);
             }
         } else {
             return Err(BpfdError::NoProgramsLoaded);
@@ -252,7 +239,7 @@ impl BpfManager {
             .program_mut(DISPATCHER_PROGRAM_NAME)
             .unwrap()
             .try_into()?;
-        let mut old_links = vec![];
+        let dispatcher_fd = dispatcher.fd().unwrap();
         let mut extensions = self
             .programs
             .get_mut(iface)
@@ -260,30 +247,22 @@ impl BpfManager {
             .values_mut()
             .collect::<Vec<&mut ExtensionProgram>>();
         extensions.sort_by(|a, b| a.metadata.cmp(&b.metadata));
+        let running = extensions
+            .iter()
+            .map(|v| v.metadata.attached)
+            .collect::<Vec<_>>();
+
+        // Load and attach new programs first. This is where things usually go
+        // wrong, and nothing live on the interface has been touched yet.
         for (i, v) in extensions.iter_mut().enumerate() {
-            if v.metadata.attached {
-                let ext: &mut Extension = v
-                    .loader
-                    .as_mut()
-                    .unwrap()
-                    .programs_mut()
-                    .next()
-                    .unwrap()
-                    .1
-                    .try_into()?;
-                let target_fn = format!("prog{}", i);
-                let old_link = v.link.take().unwrap();
-                let new_link_id = ext
-                    .attach_to_program(dispatcher.fd().unwrap(), &target_fn)
-                    .unwrap();
-                old_links.push(old_link);
-                v.link = Some(ext.forget_link(new_link_id)?);
-                v.current_position = Some(i);
-                v.metadata.attached = true;
-            } else {
-                let mut ext_loader = BpfLoader::new()
-                    .extension(&v.metadata.name)
-                    .load_file(v.path.clone())?;
+            if !v.metadata.attached {
+                // Keep the loader on the program straight away so that its fd
+                // can be closed if loading or attaching fails below
+                let ext_loader = v.loader.insert(
+                    BpfLoader::new()
+                        .extension(&v.metadata.name)
+                        .load_file(v.path.clone())?,
+                );
 
                 let ext: &mut Extension = ext_loader
                     .program_mut(&v.metadata.name)
@@ -292,15 +271,38 @@ impl BpfManager {
 
                 let target_fn = format!("prog{}", i);
 
-                ext.load(dispatcher.fd().unwrap(), &target_fn)?;
+                ext.load(dispatcher_fd, &target_fn)?;
                 let ext_link = ext.attach()?;
                 v.link = Some(ext.forget_link(ext_link)?);
-                v.loader = Some(ext_loader);
                 v.current_position = Some(i);
                 v.metadata.attached = true;
             }
         }
-        Ok(old_links)
+
+        // Then move the running programs over to the new dispatcher. If one can't
+        // be moved, put back the ones that were so that they stay linked to the
+        // dispatcher that's still attached to the interface.
+        let mut moved = vec![];
+        for i in 0..extensions.len() {
+            if !running[i] {
+                continue;
+            }
+            match relink_extension(&mut *extensions[i], dispatcher_fd, &format!("prog{}", i)) {
+                Ok(link) => {
+                    let v = &mut extensions[i];
+                    moved.push((i, v.link.replace(link).unwrap(), v.current_position));
+                    v.current_position = Some(i);
+                }
+                Err(e) => {
+                    for (j, old_link, old_position) in moved {
+                        extensions[j].link = Some(old_link);
+                        extensions[j].current_position = old_position;
+                    }
+                    return Err(e);
+                }
+            }
+        }
+        Ok(moved.into_iter().map(|(_, old_link, _)| old_link).collect())
     }
 
     fn update_or_replace_dispatcher(
@@ -312,43 +314,148 @@ impl BpfManager {
             .program_mut(DISPATCHER_PROGRAM_NAME)
             .unwrap()
             .try_into()?;
-        if let Some(mut d) = self.dispatchers.remove(&iface) {
-            let link = dispatcher.attach_to_link(d.link.take().unwrap()).unwrap();
-            let owned_link = dispatcher.forget_link(link)?;
-            self.dispatchers.insert(
-                iface.clone(),
-                DispatcherProgram {
-                    loader: dispatcher_loader,
-                    link: Some(owned_link),
-                },
-            );
-            // HACK: Close old dispatcher.
-            // I'm not sure why this doesn't get cleaned up on drop of `Bpf`...
-            // Probably some fancy refcount thing that isn't aware of bpf_link_update.
-            // We should offer program.unload() to avoid unsafe + also fix this in Aya.
-            let old_dispatcher: &mut Xdp = d
-                .loader
-                .program_mut(DISPATCHER_PROGRAM_NAME)
-                .unwrap()
-                .try_into()?;
-            if let Some(fd) = old_dispatcher.fd() {
-                close(fd).unwrap();
+        let mut lost = false;
+        let attached = if let Some(mut d) = self.dispatchers.remove(&iface) {
+            let updated = dispatcher.attach_to_link(d.link.take().unwrap());
+            close_dispatcher(&mut d.loader)?;
+            match updated {
+                Ok(link) => Ok((link, d.mode, d.fallback_reason)),
+                Err(e) => {
+                    // The old link went with the failed update, so the interface
+                    // is left without a dispatcher. Attach the new one from scratch
+                    // rather than losing every program on it.
+                    warn!("unable to update dispatcher link on {}: {}", iface, e);
+                    lost = true;
+                    attach_dispatcher(dispatcher, &iface)
+                }
             }
         } else {
-            let link = dispatcher.attach(&iface, XdpFlags::default()).unwrap();
-            let owned_link = dispatcher.forget_link(link)?;
-            self.dispatchers.insert(
-                iface.clone(),
-                DispatcherProgram {
-                    loader: dispatcher_loader,
-                    link: Some(owned_link),
-                },
-            );
+            // The kernel refuses to attach a link over an XDP program that was
+            // attached by someone else, so we never silently replace it.
+            attach_dispatcher(dispatcher, &iface)
+        };
+        let (link, mode, fallback_reason) = match attached {
+            Ok(attached) => attached,
+            Err(e) => {
+                close_dispatcher(&mut dispatcher_loader)?;
+                if lost {
+                    // Nothing is attached to the interface any more, so don't
+                    // keep reporting its programs as loaded
+                    if let Some(mut programs) = self.programs.remove(&iface) {
+                        for program in programs.values_mut() {
+                            close_extension(program)?;
+                        }
+                    }
+                    return Err(BpfdError::DispatcherLost(iface, Box::new(e)));
+                }
+                return Err(e);
+            }
+        };
+        info!(
+            "dispatcher attached to {} in {} mode",
+            iface,
+            xdp_mode_name(mode)
+        );
+
+        let dispatcher: &mut Xdp = dispatcher_loader
+            .program_mut(DISPATCHER_PROGRAM_NAME)
+            .unwrap()
+            .try_into()?;
+        let owned_link = dispatcher.forget_link(link)?;
+        self.dispatchers.insert(
+            iface,
+            DispatcherProgram {
+                loader: dispatcher_loader,
+                link: Some(owned_link),
+                mode,
+                fallback_reason,
+            },
+        );
+        Ok(())
+    }
+
+    /// Loads a new dispatcher for the programs on `iface`, moves them over to
+    /// it and swaps it in for the one that's attached, if there is one.
+    fn rebuild_dispatcher(&mut self, iface: &str) -> Result<(), BpfdError> {
+        let num_progs = self.programs.get(iface).map_or(0, |p| p.len());
+        let mut dispatcher_loader = new_dispatcher(num_progs as u8, self.dispatcher_bytes)?;
+
+        // Keep old_links in scope until after this function exits to avoid dropping
+        // them before the new dispatcher is attached
+        let _old_links = match self.attach_extensions(iface, &mut dispatcher_loader) {
+            Ok(old_links) => old_links,
+            Err(e) => {
+                close_dispatcher(&mut dispatcher_loader)?;
+                return Err(e);
+            }
+        };
+        // On error the new dispatcher has already been closed
+        self.update_or_replace_dispatcher(iface.to_string(), dispatcher_loader)
+    }
+
+    /// Removes a program that failed to load or attach, so it doesn't keep
+    /// taking up a slot on the interface.
+    fn forget_program(&mut self, iface: &str, id: Uuid) -> Result<(), BpfdError> {
+        // The programs are already gone if the interface lost its dispatcher
+        if let Some(programs) = self.programs.get_mut(iface) {
+            if let Some(mut program) = programs.remove(&id) {
+                close_extension(&mut program)?;
+            }
+            if programs.is_empty() {
+                self.programs.remove(iface);
+            }
         }
         Ok(())
     }
 }
 
+// HACK: Close the dispatcher program by hand.
+// I'm not sure why this doesn't get cleaned up on drop of `Bpf`...
+// Probably some fancy refcount thing that isn't aware of bpf_link_update.
+// We should offer program.unload() to avoid unsafe + also fix this in Aya.
+fn close_dispatcher(loader: &mut Bpf) -> Result<(), BpfdError> {
+    let dispatcher: &mut Xdp = loader
+        .program_mut(DISPATCHER_PROGRAM_NAME)
+        .unwrap()
+        .try_into()?;
+    if let Some(fd) = dispatcher.fd() {
+        close(fd).unwrap();
+    }
+    Ok(())
+}
+
+fn relink_extension(
+    program: &mut ExtensionProgram,
+    dispatcher_fd: RawFd,
+    target_fn: &str,
+) -> Result<OwnedLink<ExtensionLink>, BpfdError> {
+    let ext: &mut Extension = program
+        .loader
+        .as_mut()
+        .unwrap()
+        .programs_mut()
+        .next()
+        .unwrap()
+        .1
+        .try_into()?;
+    let link_id = ext.attach_to_program(dispatcher_fd, target_fn)?;
+    Ok(ext.forget_link(link_id)?)
+}
+
+// HACK: Close the extension program by hand, for the same reason as above.
+fn close_extension(program: &mut ExtensionProgram) -> Result<(), BpfdError> {
+    if let Some(loader) = program.loader.as_mut() {
+        let ext: &mut Extension = loader
+            .program_mut(program.metadata.name.as_str())
+            .unwrap()
+            .try_into()?;
+        if let Some(fd) = ext.fd() {
+            close(fd).unwrap();
+        }
+    }
+    Ok(())
+}
+
 fn new_dispatcher(num_progs_enabled: u8, bytes: &'static [u8]) -> Result<Bpf, BpfdError> {
     let config = XdpDispatcherConfig {
         num_progs_enabled,
@@ -367,3 +474,96 @@ fn new_dispatcher(num_progs_enabled: u8, bytes: &'static [u8]) -> Result<Bpf, Bp
 
     Ok(dispatcher_loader)
 }
+
+/// Attaches the dispatcher in the first of `XDP_MODES` that `iface` accepts.
+/// Returns the mode it ended up in and, if that's not the first one, why the
+/// previous mode was rejected.
+fn attach_dispatcher(
+    dispatcher: &mut Xdp,
+    iface: &str,
+) -> Result<(XdpLinkId, XdpFlags, Option<String>), BpfdError> {
+    let mut fallback_reason = None;
+    for (i, mode) in XDP_MODES.iter().enumerate() {
+        let e = match dispatcher.attach(iface, *mode) {
+            Ok(link) => return Ok((link, *mode, fallback_reason)),
+            Err(e) => e,
+        };
+        if is_hook_busy(&e) {
+            return Err(BpfdError::InterfaceBusy(iface.to_string(), e));
+        }
+        // Only fall back when the driver can't do this mode. Anything else is
+        // an error.
+        if i + 1 == XDP_MODES.len() || !is_unsupported_mode(&e) {
+            return Err(BpfdError::DispatcherAttachFailed(iface.to_string(), e));
+        }
+        // aya's message for a failed syscall only names the call, so use the
+        // errno underneath as that's the actual reason for falling back
+        let reason = format!("{} mode: {}", xdp_mode_name(*mode), io_error(&e).unwrap());
+        info!("{} rejected {}, falling back", iface, reason);
+        fallback_reason = Some(reason);
+    }
+    unreachable!("XDP_MODES is not empty")
+}
+
+fn xdp_mode_name(mode: XdpFlags) -> &'static str {
+    if mode == XdpFlags::DRV_MODE {
+        "drv"
+    } else if mode == XdpFlags::SKB_MODE {
+        "skb"
+    } else {
+        "default"
+    }
+}
+
+fn is_unsupported_mode(err: &ProgramError) -> bool {
+    matches!(
+        io_error(err).and_then(|e| e.raw_os_error()),
+        Some(errno) if errno == Errno::EOPNOTSUPP as i32 || errno == Errno::EINVAL as i32
+    )
+}
+
+// EBUSY: another program or link is attached in the same mode.
+// EEXIST: a program is attached in the other of native/generic mode.
+fn is_hook_busy(err: &ProgramError) -> bool {
+    matches!(
+        io_error(err).and_then(|e| e.raw_os_error()),
+        Some(errno) if errno == Errno::EBUSY as i32 || errno == Errno::EEXIST as i32
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io;
+
+    use super::*;
+
+    fn syscall_error(errno: Errno) -> ProgramError {
+        ProgramError::SyscallError {
+            call: "bpf_link_create".to_owned(),
+            io_error: io::Error::from_raw_os_error(errno as i32),
+        }
+    }
+
+    #[test]
+    fn unsupported_mode_falls_back() {
+        assert!(is_unsupported_mode(&syscall_error(Errno::EOPNOTSUPP)));
+        assert!(is_unsupported_mode(&syscall_error(Errno::EINVAL)));
+    }
+
+    #[test]
+    fn foreign_program_is_busy() {
+        assert!(is_hook_busy(&syscall_error(Errno::EBUSY)));
+        assert!(is_hook_busy(&syscall_error(Errno::EEXIST)));
+        assert!(!is_hook_busy(&syscall_error(Errno::EOPNOTSUPP)));
+        assert!(!is_hook_busy(&ProgramError::NotLoaded));
+    }
+
+    #[test]
+    fn other_errors_do_not_fall_back() {
+        // EBUSY: another program or link is already attached in this mode.
+        // EEXIST: a program is attached in the other of native/generic mode.
+        assert!(!is_unsupported_mode(&syscall_error(Errno::EBUSY)));
+        assert!(!is_unsupported_mode(&syscall_error(Errno::EEXIST)));
+        assert!(!is_unsupported_mode(&ProgramError::NotLoaded));
+    }
+}
@@ -1,3 +1,6 @@
+use std::{error::Error as _, io};
+
+use aya::programs::ProgramError;
 use thiserror::Error;
 
 #[derive(Debug, Error)]
@@ -8,6 +11,12 @@ pub(crate) enum BpfdError {
     BpfProgramError(#[from] aya::programs::ProgramError),
     #[error(transparent)]
     BpfLoadError(#[from] aya::BpfError),
+    #[error("Unable to attach dispatcher to {0}: {}", with_errno(.1))]
+    DispatcherAttachFailed(String, #[source] aya::programs::ProgramError),
+    #[error("Another XDP program is already attached to {0}: {}", with_errno(.1))]
+    InterfaceBusy(String, #[source] aya::programs::ProgramError),
+    #[error("Lost the dispatcher on {0} and unloaded all programs on it: {1}")]
+    DispatcherLost(String, #[source] Box<BpfdError>),
     #[error("No room to attach program. Please remove one and try again.")]
     TooManyPrograms,
     #[error("No programs loaded to requested interface")]
@@ -19,3 +28,24 @@ pub(crate) enum BpfdError {
     #[error("Map not loaded")]
     MapNotLoaded,
 }
+
+/// Finds the `io::Error` behind a `ProgramError`, if there is one.
+pub(crate) fn io_error(err: &ProgramError) -> Option<&io::Error> {
+    let mut source = err.source();
+    while let Some(e) = source {
+        if let Some(io_error) = e.downcast_ref::<io::Error>() {
+            return Some(io_error);
+        }
+        source = e.source();
+    }
+    None
+}
+
+// aya's message for a failed syscall only names the call, so add the errno
+// as that's what tells the user why it failed.
+fn with_errno(err: &ProgramError) -> String {
+    match io_error(err) {
+        Some(io_error) => format!("{}: {}", err, io_error),
+        None => err.to_string(),
+    }
+}
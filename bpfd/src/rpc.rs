@@ -57,7 +57,7 @@ impl Loader for BpfdLoader {
                 reply.id = id.to_string();
                 Ok(Response::new(reply))
             }
-            Err(e) => Err(Status::aborted(format!("{}", e))),
+            Err(e) => Err(error_status(e)),
         }
     }
 
@@ -87,7 +87,7 @@ impl Loader for BpfdLoader {
         let res = resp_rx.await.unwrap();
         match res {
             Ok(_) => Ok(Response::new(reply)),
-            Err(e) => Err(Status::aborted(format!("{}", e))),
+            Err(e) => Err(error_status(e)),
         }
     }
 
@@ -116,11 +116,13 @@ impl Loader for BpfdLoader {
                         path: r.path,
                         position: r.position as u32,
                         priority: r.priority,
+                        xdp_mode: r.xdp_mode,
+                        xdp_fallback_reason: r.xdp_fallback_reason,
                     })
                 }
                 Ok(Response::new(reply))
             }
-            Err(e) => Err(Status::aborted(format!("{}", e))),
+            Err(e) => Err(error_status(e)),
         }
     }
 
@@ -148,11 +150,20 @@ impl Loader for BpfdLoader {
         let res = resp_rx.await.unwrap();
         match res {
             Ok(_) => Ok(Response::new(reply)),
-            Err(e) => Err(Status::aborted(format!("{}", e))),
+            Err(e) => Err(error_status(e)),
         }
     }
 }
 
+/// Another program owning the hook is something the caller can act on, so
+/// it gets its own status code.
+fn error_status(e: BpfdError) -> Status {
+    match e {
+        BpfdError::InterfaceBusy(..) => Status::failed_precondition(format!("{}", e)),
+        _ => Status::aborted(format!("{}", e)),
+    }
+}
+
 /// Multiple different commands are multiplexed over a single channel.
 #[derive(Debug)]
 pub(crate) enum Command {
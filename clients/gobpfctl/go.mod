@@ -0,0 +1,20 @@
+module github.com/redhat-et/bpfd/clients/gobpfctl
+
+go 1.18
+
+replace github.com/redhat-et/bpfd/clients/gobpfd => ../gobpfd
+
+require (
+	github.com/cilium/ebpf v0.9.0
+	github.com/redhat-et/bpfd/clients/gobpfd v0.0.0-20220529154805-b196cc1fe9d0
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a
+	google.golang.org/grpc v1.46.2
+)
+
+require (
+	github.com/golang/protobuf v1.5.2 // indirect
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
+	golang.org/x/text v0.3.3 // indirect
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
+	google.golang.org/protobuf v1.28.0 // indirect
+)
@@ -0,0 +1,257 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/redhat-et/bpfd/clients/gobpfd"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const usage = `Usage: gobpfctl [-addr host:port] <command> [flags] [args]
+
+Commands:
+  load -p <type> -i <iface> -s <section> [-priority <n>] <path>
+  unload -i <iface> <id>
+  list -i <iface>
+  get -i <iface> <id>
+  get-map -i <iface> -m <map> <id>
+
+get-map receives the map over a unix socket, so it only works when -addr
+is a loopback address, i.e. bpfd is running on this host.
+`
+
+func main() {
+	addr := flag.String("addr", "[::1]:50051", "address of the bpfd Loader service")
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*addr, flag.Arg(0), flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(addr, cmd string, args []string) error {
+	ctx := context.Background()
+	// Set up a connection to the server.
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("did not connect: %v", err)
+	}
+	defer conn.Close()
+	c := gobpfd.NewLoaderClient(conn)
+
+	switch cmd {
+	case "load":
+		return load(ctx, c, args)
+	case "unload":
+		return unload(ctx, c, args)
+	case "list":
+		return list(ctx, c, args)
+	case "get":
+		return get(ctx, c, args)
+	case "get-map":
+		if !isLoopback(addr) {
+			return fmt.Errorf("get-map: bpfd must be running on this host, not %s", addr)
+		}
+		return getMap(ctx, c, args)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func load(ctx context.Context, c gobpfd.LoaderClient, args []string) error {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	programType := fs.String("p", "", "program type: xdp, tc_ingress or tc_egress")
+	iface := fs.String("i", "", "interface to attach to")
+	sectionName := fs.String("s", "", "section name of the program")
+	priority := fs.Int("priority", 50, "priority of the program on the interface")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("load: path to the program is required")
+	}
+
+	pt, ok := gobpfd.ProgramType_value[strings.ToUpper(*programType)]
+	if !ok {
+		return fmt.Errorf("%s is not a valid program type", *programType)
+	}
+	// bpfd opens the file itself, so it must not be relative to our cwd
+	path, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Load(ctx, &gobpfd.LoadRequest{
+		Path:        path,
+		SectionName: *sectionName,
+		ProgramType: gobpfd.ProgramType(pt),
+		Priority:    int32(*priority),
+		Iface:       *iface,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(res.GetId())
+	return nil
+}
+
+func unload(ctx context.Context, c gobpfd.LoaderClient, args []string) error {
+	fs := flag.NewFlagSet("unload", flag.ExitOnError)
+	iface := fs.String("i", "", "interface the program is attached to")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("unload: program id is required")
+	}
+
+	_, err := c.Unload(ctx, &gobpfd.UnloadRequest{Iface: *iface, Id: fs.Arg(0)})
+	return err
+}
+
+func list(ctx context.Context, c gobpfd.LoaderClient, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	iface := fs.String("i", "", "interface to list programs for")
+	fs.Parse(args)
+
+	res, err := c.List(ctx, &gobpfd.ListRequest{Iface: *iface})
+	if err != nil {
+		return err
+	}
+	for _, r := range res.GetResults() {
+		printResult(r)
+	}
+	return nil
+}
+
+// get prints a single program. The Loader service has no Get RPC, so
+// this filters the results of List by id.
+func get(ctx context.Context, c gobpfd.LoaderClient, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	iface := fs.String("i", "", "interface the program is attached to")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("get: program id is required")
+	}
+
+	res, err := c.List(ctx, &gobpfd.ListRequest{Iface: *iface})
+	if err != nil {
+		return err
+	}
+	for _, r := range res.GetResults() {
+		if r.GetId() == fs.Arg(0) {
+			printResult(r)
+			return nil
+		}
+	}
+	return fmt.Errorf("no program with id %s on %s", fs.Arg(0), *iface)
+}
+
+func printResult(r *gobpfd.ListResponse_ListResult) {
+	fmt.Printf("%d: %s\n\tname: %q\n\tpriority: %d\n\tpath: %s\n\txdp mode: %s\n",
+		r.GetPosition(), r.GetId(), r.GetName(), r.GetPriority(), r.GetPath(), r.GetXdpMode())
+	if reason := r.GetXdpFallbackReason(); reason != "" {
+		fmt.Printf("\txdp fallback reason: %s\n", reason)
+	}
+}
+
+// getMap asks bpfd to send us the fd of a map over a unix socket and
+// dumps every key/value pair in it as hex.
+func getMap(ctx context.Context, c gobpfd.LoaderClient, args []string) error {
+	fs := flag.NewFlagSet("get-map", flag.ExitOnError)
+	iface := fs.String("i", "", "interface the program is attached to")
+	mapName := fs.String("m", "", "name of the map to dump")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("get-map: program id is required")
+	}
+
+	dir, err := os.MkdirTemp("", "gobpfctl")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	sockAddr := filepath.Join(dir, "map.sock")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sockAddr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	_, err = c.GetMap(ctx, &gobpfd.GetMapRequest{
+		Iface:      *iface,
+		Id:         fs.Arg(0),
+		MapName:    *mapName,
+		SocketPath: sockAddr,
+	})
+	if err != nil {
+		return err
+	}
+
+	// bpfd has sent the fd by the time GetMap returns, so don't wait long
+	// in case it never does.
+	if err := sock.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := sock.ReadMsgUnix([]byte{}, oob)
+	if err != nil {
+		return err
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return err
+	}
+	if len(cmsgs) == 0 {
+		return fmt.Errorf("no fd received from bpfd")
+	}
+	fds, err := unix.ParseUnixRights(&cmsgs[0])
+	if err != nil {
+		return err
+	}
+
+	m, err := ebpf.NewMapFromFD(fds[0])
+	if err != nil {
+		unix.Close(fds[0])
+		return err
+	}
+	defer m.Close()
+
+	key, err := m.NextKeyBytes(nil)
+	for ; err == nil && key != nil; key, err = m.NextKeyBytes(key) {
+		value, err := m.LookupBytes(key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%x: %x\n", key, value)
+	}
+	return err
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}